@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/jordan-wright/email"
+	"github.com/spf13/viper"
+)
+
+// FileMeta carries the information a Deliverer needs about a file beyond its path.
+// Subject and Body default to Base when empty, which is how a plain, unsplit file is
+// delivered; DeliverSplit overrides them to label each part of a multi-part series
+// and its manifest. SignaturePath is set by Deliver after running security.mode's
+// detached-signature modes and should be treated as read-only by Deliverer implementations.
+type FileMeta struct {
+	Base          string
+	Subject       string
+	Body          string
+	Addressees    []string
+	SignaturePath string
+}
+
+// NewFileMeta builds the FileMeta for file from the current configuration.
+func NewFileMeta(file string) FileMeta {
+	return FileMeta{
+		Base:       filepath.Base(file),
+		Addressees: viper.GetStringSlice("email.addressees"),
+	}
+}
+
+// Deliverer hands a file off to some destination: an SMTP mailbox, a local MTA, an
+// IMAP folder, object storage, or an HTTP endpoint.
+type Deliverer interface {
+	Deliver(ctx context.Context, file string, meta FileMeta) error
+}
+
+// namedDeliverer pairs a Deliverer with the "delivery.backends" name it was
+// configured under (e.g. "smtp"), so Deliver can key per-backend retry settings and
+// DeliveryStatus off something stable across retries.
+type namedDeliverer struct {
+	name string
+	Deliverer
+}
+
+// NewDeliverers builds the Deliverer chain configured under "delivery.backends", e.g.
+// ["smtp", "s3"]. Every configured backend is delivered to; a file is only considered
+// delivered once all of them succeed, matching the "move to save/ once sent" semantics
+// main already relies on. An empty or absent delivery.backends falls back to "smtp",
+// which is how fm behaved before backends existed.
+func NewDeliverers() ([]namedDeliverer, error) {
+	backends := viper.GetStringSlice("delivery.backends")
+	if len(backends) == 0 {
+		backends = []string{"smtp"}
+	}
+
+	deliverers := make([]namedDeliverer, 0, len(backends))
+	for _, backend := range backends {
+		var d Deliverer
+		switch backend {
+		case "smtp":
+			d = &SMTPDeliverer{}
+		case "sendmail":
+			d = &SendmailDeliverer{}
+		case "imap":
+			d = &IMAPDeliverer{}
+		case "s3":
+			d = &S3Deliverer{}
+		case "webhook":
+			d = &WebhookDeliverer{}
+		default:
+			return nil, fmt.Errorf("unknown delivery backend %q", backend)
+		}
+		deliverers = append(deliverers, namedDeliverer{name: backend, Deliverer: d})
+	}
+	return deliverers, nil
+}
+
+// DeliveryStatus tracks which backends, keyed by their "delivery.backends" name, have
+// already delivered a given file. The queue (see Job) persists it across retries so a
+// retry after a partial failure only re-attempts the backends that actually failed,
+// instead of re-sending to backends that already succeeded.
+type DeliveryStatus map[string]bool
+
+func (s DeliveryStatus) delivered(deliverers []namedDeliverer) bool {
+	for _, d := range deliverers {
+		if !s[d.name] {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitDeliveryStatus tracks per-backend delivery status for each part of a split
+// series, keyed the same way DeliverSplit labels them ("part-1", "part-2", ...,
+// "manifest"), so a retry after a partial failure resumes with the first undelivered
+// part instead of resending everything from part 1.
+type SplitDeliveryStatus map[string]DeliveryStatus
+
+// forKey returns the DeliveryStatus for key, creating it if this is the first attempt.
+func (s SplitDeliveryStatus) forKey(key string) DeliveryStatus {
+	status, ok := s[key]
+	if !ok {
+		status = DeliveryStatus{}
+		s[key] = status
+	}
+	return status
+}
+
+// backendAttempts and backendBackoff read delivery.<backend>.retry.*, falling back to
+// the shared delivery.retry.* settings and then a hardcoded default, so e.g. S3 can be
+// given a larger retry budget than SMTP.
+func backendAttempts(backend string) int {
+	if n := viper.GetInt(fmt.Sprintf("delivery.%s.retry.max_attempts", backend)); n > 0 {
+		return n
+	}
+	if n := viper.GetInt("delivery.retry.max_attempts"); n > 0 {
+		return n
+	}
+	return 1
+}
+
+func backendBackoff(backend string) time.Duration {
+	if d := viper.GetDuration(fmt.Sprintf("delivery.%s.retry.backoff", backend)); d > 0 {
+		return d
+	}
+	if d := viper.GetDuration("delivery.retry.backoff"); d > 0 {
+		return d
+	}
+	return time.Second
+}
+
+// Deliver runs file through the configured security.mode once, then hands the
+// resulting attachment to every deliverer not already marked done in status, using
+// each backend's own retry budget. Protecting the file here, ahead of the fan-out,
+// guarantees every backend (SMTP, S3, webhook, ...) ships the signed/encrypted copy
+// rather than just the email-building ones. It returns the first backend's error once
+// that backend has exhausted its attempts; remaining backends still run so that, say,
+// an S3 upload isn't skipped just because SMTP is down. status is mutated in place so
+// a caller that persists it (see the queue worker) can retry only what failed.
+func Deliver(ctx context.Context, deliverers []namedDeliverer, file string, meta FileMeta, status DeliveryStatus) error {
+	attachPath, sigPath, cleanup, err := ProtectFile(file, meta)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	meta.SignaturePath = sigPath
+
+	var firstErr error
+	for _, d := range deliverers {
+		if status[d.name] {
+			continue
+		}
+
+		attempts := backendAttempts(d.name)
+		backoff := backendBackoff(d.name)
+
+		var err error
+		for attempt := 1; attempt <= attempts; attempt++ {
+			if err = d.Deliver(ctx, attachPath, meta); err == nil {
+				status[d.name] = true
+				break
+			}
+			if attempt < attempts {
+				time.Sleep(backoff * time.Duration(attempt))
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// buildEmail assembles the jordan-wright/email message shared by the SMTP, sendmail
+// and IMAP backends. file is expected to already be the protected (signed/encrypted)
+// attachment, and meta.SignaturePath, if set, is attached alongside it.
+func buildEmail(file string, meta FileMeta) (*email.Email, error) {
+	subject := meta.Subject
+	if subject == "" {
+		subject = meta.Base
+	}
+	body := meta.Body
+	if body == "" {
+		body = meta.Base
+	}
+
+	em := email.NewEmail()
+	em.From = viper.GetString("email.sender")
+	em.To = meta.Addressees
+	em.Subject = subject
+	em.Text = []byte(body)
+	if _, err := em.AttachFile(file); err != nil {
+		return nil, fmt.Errorf("attach file %s\n error: %s", meta.Base, err.Error())
+	}
+	if meta.SignaturePath != "" {
+		if _, err := em.AttachFile(meta.SignaturePath); err != nil {
+			return nil, fmt.Errorf("attach signature for %s\n error: %s", meta.Base, err.Error())
+		}
+	}
+	return em, nil
+}
+
+// SMTPDeliverer sends the file as an email attachment over SMTP on a TLS connection
+// opened from the start (not STARTTLS), the way fm has always delivered files.
+type SMTPDeliverer struct{}
+
+func (d *SMTPDeliverer) Deliver(ctx context.Context, file string, meta FileMeta) error {
+	em, err := buildEmail(file, meta)
+	if err != nil {
+		return err
+	}
+
+	host := viper.GetString("smtp.host")
+	port := viper.GetString("smtp.port")
+	username := viper.GetString("smtp.username")
+	password := viper.GetString("smtp.password")
+	t := &tls.Config{InsecureSkipVerify: true, ServerName: host}
+	auth := smtp.PlainAuth("", username, password, host)
+
+	if err := em.SendWithTLS(host+":"+port, auth, t); err != nil {
+		return fmt.Errorf("send file %s\n error: %s", meta.Base, err.Error())
+	}
+	return nil
+}
+
+// SendmailDeliverer hands the message to a local MTA binary over stdin, for hosts
+// that already have mail delivery configured via sendmail/postfix/exim.
+type SendmailDeliverer struct{}
+
+func (d *SendmailDeliverer) Deliver(ctx context.Context, file string, meta FileMeta) error {
+	em, err := buildEmail(file, meta)
+	if err != nil {
+		return err
+	}
+	raw, err := em.Bytes()
+	if err != nil {
+		return fmt.Errorf("build message for %s\n error: %s", meta.Base, err.Error())
+	}
+
+	path := viper.GetString("delivery.sendmail.path")
+	if path == "" {
+		path = "/usr/sbin/sendmail"
+	}
+	args := append([]string{"-t"}, meta.Addressees...)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = bytes.NewReader(raw)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sendmail file %s\n error: %s\n output: %s", meta.Base, err.Error(), out)
+	}
+	return nil
+}
+
+// IMAPDeliverer appends the message directly to an IMAP folder (e.g. "Sent"),
+// archiving it without an SMTP round-trip.
+type IMAPDeliverer struct{}
+
+func (d *IMAPDeliverer) Deliver(ctx context.Context, file string, meta FileMeta) error {
+	em, err := buildEmail(file, meta)
+	if err != nil {
+		return err
+	}
+	raw, err := em.Bytes()
+	if err != nil {
+		return fmt.Errorf("build message for %s\n error: %s", meta.Base, err.Error())
+	}
+
+	host := viper.GetString("delivery.imap.host")
+	port := viper.GetString("delivery.imap.port")
+	username := viper.GetString("delivery.imap.username")
+	password := viper.GetString("delivery.imap.password")
+	folder := viper.GetString("delivery.imap.folder")
+	if folder == "" {
+		folder = "Sent"
+	}
+
+	c, err := client.DialTLS(host+":"+port, nil)
+	if err != nil {
+		return fmt.Errorf("dial imap for %s\n error: %s", meta.Base, err.Error())
+	}
+	defer c.Logout()
+
+	if err := c.Login(username, password); err != nil {
+		return fmt.Errorf("login imap for %s\n error: %s", meta.Base, err.Error())
+	}
+
+	flags := []string{imap.SeenFlag}
+	if err := c.Append(folder, flags, time.Now(), bytes.NewReader(raw)); err != nil {
+		return fmt.Errorf("append imap message for %s\n error: %s", meta.Base, err.Error())
+	}
+	return nil
+}
+
+// S3Deliverer uploads the file to an S3 or MinIO-compatible bucket, for recipients
+// that want object storage instead of email.
+type S3Deliverer struct{}
+
+func (d *S3Deliverer) Deliver(ctx context.Context, file string, meta FileMeta) error {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("load aws config for %s\n error: %s", meta.Base, err.Error())
+	}
+
+	var opts []func(*s3.Options)
+	if endpoint := viper.GetString("delivery.s3.endpoint"); endpoint != "" {
+		opts = append(opts, func(o *s3.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		})
+	}
+	client := s3.NewFromConfig(cfg, opts...)
+
+	bucket := viper.GetString("delivery.s3.bucket")
+	prefix := viper.GetString("delivery.s3.prefix")
+	if err := s3PutFile(ctx, client, bucket, filepath.Join(prefix, filepath.Base(file)), file); err != nil {
+		return fmt.Errorf("put object %s\n error: %s", meta.Base, err.Error())
+	}
+	if meta.SignaturePath != "" {
+		key := filepath.Join(prefix, filepath.Base(meta.SignaturePath))
+		if err := s3PutFile(ctx, client, bucket, key, meta.SignaturePath); err != nil {
+			return fmt.Errorf("put signature for %s\n error: %s", meta.Base, err.Error())
+		}
+	}
+	return nil
+}
+
+func s3PutFile(ctx context.Context, c *s3.Client, bucket, key, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	})
+	return err
+}
+
+// WebhookDeliverer POSTs the file as multipart form data to an HTTP endpoint.
+type WebhookDeliverer struct{}
+
+func (d *WebhookDeliverer) Deliver(ctx context.Context, file string, meta FileMeta) error {
+	url := viper.GetString("delivery.webhook.url")
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := webhookAddFile(w, "file", file); err != nil {
+		return fmt.Errorf("build webhook body for %s\n error: %s", meta.Base, err.Error())
+	}
+	if meta.SignaturePath != "" {
+		if err := webhookAddFile(w, "signature", meta.SignaturePath); err != nil {
+			return fmt.Errorf("build webhook body for %s\n error: %s", meta.Base, err.Error())
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("build webhook body for %s\n error: %s", meta.Base, err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return fmt.Errorf("build webhook request for %s\n error: %s", meta.Base, err.Error())
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook for %s\n error: %s", meta.Base, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("post webhook for %s\n error: unexpected status %s", meta.Base, resp.Status)
+	}
+	return nil
+}
+
+func webhookAddFile(w *multipart.Writer, field, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	part, err := w.CreateFormFile(field, filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
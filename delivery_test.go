@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestDeliveryStatusDelivered(t *testing.T) {
+	deliverers := []namedDeliverer{{name: "smtp"}, {name: "s3"}}
+
+	status := DeliveryStatus{}
+	if status.delivered(deliverers) {
+		t.Error("delivered() = true for an empty status, want false")
+	}
+
+	status["smtp"] = true
+	if status.delivered(deliverers) {
+		t.Error("delivered() = true with only one of two backends done, want false")
+	}
+
+	status["s3"] = true
+	if !status.delivered(deliverers) {
+		t.Error("delivered() = false once every backend is marked done, want true")
+	}
+}
+
+func TestSplitDeliveryStatusForKeyCreatesOnce(t *testing.T) {
+	status := SplitDeliveryStatus{}
+	first := status.forKey("part-1")
+	first["smtp"] = true
+
+	second := status.forKey("part-1")
+	if !second["smtp"] {
+		t.Error("forKey returned a fresh DeliveryStatus instead of the one already recorded")
+	}
+}
+
+func TestBackendAttemptsFallback(t *testing.T) {
+	defer viper.Set("delivery.retry.max_attempts", nil)
+	defer viper.Set("delivery.s3.retry.max_attempts", nil)
+
+	if got := backendAttempts("smtp"); got != 1 {
+		t.Errorf("backendAttempts with nothing configured = %d, want 1", got)
+	}
+
+	viper.Set("delivery.retry.max_attempts", 3)
+	if got := backendAttempts("smtp"); got != 3 {
+		t.Errorf("backendAttempts falling back to delivery.retry.max_attempts = %d, want 3", got)
+	}
+
+	viper.Set("delivery.s3.retry.max_attempts", 7)
+	if got := backendAttempts("s3"); got != 7 {
+		t.Errorf("backendAttempts with delivery.s3.retry.max_attempts set = %d, want 7", got)
+	}
+	if got := backendAttempts("smtp"); got != 3 {
+		t.Errorf("backendAttempts(\"smtp\") = %d, want unaffected global fallback of 3", got)
+	}
+}
+
+func TestBackendBackoffFallback(t *testing.T) {
+	defer viper.Set("delivery.retry.backoff", nil)
+	defer viper.Set("delivery.s3.retry.backoff", nil)
+
+	if got := backendBackoff("smtp"); got != time.Second {
+		t.Errorf("backendBackoff with nothing configured = %v, want %v", got, time.Second)
+	}
+
+	viper.Set("delivery.retry.backoff", 2*time.Second)
+	if got := backendBackoff("smtp"); got != 2*time.Second {
+		t.Errorf("backendBackoff falling back to delivery.retry.backoff = %v, want %v", got, 2*time.Second)
+	}
+
+	viper.Set("delivery.s3.retry.backoff", 5*time.Second)
+	if got := backendBackoff("s3"); got != 5*time.Second {
+		t.Errorf("backendBackoff with delivery.s3.retry.backoff set = %v, want %v", got, 5*time.Second)
+	}
+	if got := backendBackoff("smtp"); got != 2*time.Second {
+		t.Errorf("backendBackoff(\"smtp\") = %v, want unaffected global fallback of %v", got, 2*time.Second)
+	}
+}
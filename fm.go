@@ -3,11 +3,9 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
-	"net/smtp"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -15,7 +13,6 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/jordan-wright/email"
 	"github.com/spf13/viper"
 )
 
@@ -44,45 +41,111 @@ func init() {
 // The watch folder and extensions are retrieved from the viper configuration.
 // It then loops through the events received from the watcher and handles them accordingly.
 // If the event is a create event and the file extension matches the allowed extensions,
-// the file is emailed to the addressees and moved to the save folder.
+// the file is tracked until its size and mtime stop changing, then it is enqueued for
+// delivery and a worker goroutine drains the queue, moving the file to the save folder
+// once delivery succeeds and to the dead-letter folder once it's exhausted its retries.
+// Files carrying a configured temp/partial suffix are ignored, left for their writer to
+// rename away.
+// If the event is a create event for a directory, it is registered with the watcher so that
+// files dropped into it are picked up too. If the event is a remove event for a watched
+// directory, the watch is dropped.
 // If the event is an error event, it is logged.
-// Finally, the watch folder is added to the watcher and the program waits for user input to stop watching.
+// Finally, watch is added recursively, the queue directory is replayed and the watch
+// folder is rescanned for files missed during downtime, and the program waits for user
+// input to stop watching.
 func main() {
+	// Start listening for events.
+	watch := viper.GetString("watch.folder")
+
 	// Create new watcher.
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := NewFileWatcher(viper.GetString("watch.mode"), watch)
 	if err != nil {
 		log.Fatal("Fatal error creating watcher:", err)
 	}
 	defer watcher.Close()
 
-	// Start listening for events.
-	watch := viper.GetString("watch.folder")
 	filetypes := viper.GetStringSlice("watch.filetypes")
+	partials := viper.GetStringSlice("watch.partial_suffixes")
+	stableInterval := viper.GetDuration("watch.stable_interval")
+	if stableInterval <= 0 {
+		stableInterval = time.Second
+	}
+	stableChecks := viper.GetInt("watch.stable_checks")
+	if stableChecks <= 0 {
+		stableChecks = 2
+	}
+
+	// save/ is a delivery destination, not a source: excluding it by default keeps a
+	// moved-in file from being re-discovered through the same recursive watch that
+	// mirrors its subdirectory structure there.
+	excludes := append(viper.GetStringSlice("watch.excludes"), filepath.Join(watch, "save"))
+
+	queueDir := viper.GetString("delivery.queue.dir")
+	if queueDir == "" {
+		queueDir = filepath.Join(watch, "queue")
+	}
+	deadLetterDir := viper.GetString("delivery.queue.dead_letter_dir")
+	if deadLetterDir == "" {
+		deadLetterDir = filepath.Join(watch, "dead-letter")
+	}
+	// Likewise for the queue and dead-letter folders.
+	excludes = append(excludes, queueDir, deadLetterDir)
+
+	deliverers, err := NewDeliverers()
+	if err != nil {
+		log.Fatal("Fatal error configuring delivery backends:", err)
+	}
+
+	queue, err := NewQueue(queueDir)
+	if err != nil {
+		log.Fatal("Fatal error opening queue:", err)
+	}
+
+	tracker := NewStabilityTracker(stableInterval, stableChecks, func(file string) {
+		base := filepath.Base(file)
+		if _, err := queue.Enqueue(file, NewFileMeta(file)); err != nil {
+			log.Println(err)
+			return
+		}
+		log.Println("File:", base, "has been queued for delivery")
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go RunQueueWorker(queue, deliverers, watch, stop)
+	ServeMetrics(viper.GetString("delivery.queue.metrics_addr"), queue)
+
 	go func() {
 		for {
 			select {
-			case event, ok := <-watcher.Events:
+			case event, ok := <-watcher.Events():
 				if !ok {
 					return
 				}
 				if event.Has(fsnotify.Create) {
 					base := filepath.Base(event.Name)
 					if IsFile(event.Name) {
-						if ExtensionMatched(filetypes, filepath.Ext(event.Name)) {
-							err := EmailFile(event.Name)
-							if err != nil {
-								log.Println(err)
-								break
-							}
-							log.Println("File:", base, "has been sent to addressees")
-							os.MkdirAll(filepath.Join(watch, "save"), 0750)
-							os.Rename(event.Name, filepath.Join(watch, "save", base))
+						if IsPartialFile(partials, event.Name) {
+							log.Println("File:", base, "has been ignored as a partial file")
+						} else if ExtensionMatched(filetypes, filepath.Ext(event.Name)) {
+							tracker.Track(event.Name)
 						} else {
 							log.Println("File:", base, "has been ignored by extension")
 						}
+					} else if !ExcludeMatched(excludes, event.Name) {
+						if err := AddWatchRecursive(watcher, event.Name, excludes); err != nil {
+							log.Println("Watcher error:", err)
+						} else {
+							log.Println("Folder:", event.Name, "has been added to watch")
+						}
 					}
 				}
-			case err, ok := <-watcher.Errors:
+				if event.Has(fsnotify.Remove) {
+					// Removing a path that isn't watched is a no-op, so it's safe to
+					// call this for every Remove event without checking IsFile first.
+					watcher.Remove(event.Name)
+				}
+			case err, ok := <-watcher.Errors():
 				if !ok {
 					return
 				}
@@ -91,45 +154,64 @@ func main() {
 		}
 	}()
 
-	err = watcher.Add(watch)
-	if err != nil {
+	if err := AddWatchRecursive(watcher, watch, excludes); err != nil {
 		log.Fatal(err)
 	}
+	ScanWatchFolder(watch, filetypes, partials, excludes, queue)
 	log.Println("Watching folder:", watch)
 	log.Println("Addressees:", viper.GetStringSlice("email.addressees"))
 	log.Println("Press Enter to stop watching.")
 	fmt.Scanln()
 }
 
-// EmailFile sends an email with an attached file.
+// AddWatchRecursive walks root and registers every subdirectory with watcher, skipping
+// any directory whose path matches one of the excludes glob patterns.
 //
-// The function takes a file path as a parameter and returns an error if there is any.
-func EmailFile(file string) error {
-	time.Sleep(time.Second)
-	base := filepath.Base(file)
-
-	em := email.NewEmail()
-	em.From = viper.GetString("email.sender")
-	em.To = viper.GetStringSlice("email.addressees")
-	em.Subject = base
-	em.Text = []byte(base)
-
-	if _, err := em.AttachFile(file); err != nil {
-		return fmt.Errorf("attach file %s\n error: %s", base, err.Error())
-	}
-
-	host := viper.GetString("smtp.host")
-	port := viper.GetString("smtp.port")
-	username := viper.GetString("smtp.username")
-	password := viper.GetString("smtp.password")
-	t := &tls.Config{InsecureSkipVerify: true, ServerName: host}
-	auth := smtp.PlainAuth("", username, password, host)
+// root itself is always registered, even if it matches an exclude pattern.
+func AddWatchRecursive(watcher FileWatcher, root string, excludes []string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root && ExcludeMatched(excludes, path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
 
-	if err := em.SendWithTLS(host+":"+port, auth, t); err != nil {
-		return fmt.Errorf("send file %s\n error: %s", base, err.Error())
+// ExcludeMatched checks if path matches any of the glob patterns.
+//
+// Parameters:
+// - patterns: a slice of glob patterns to match against.
+// - path: the path to be checked.
+//
+// Return type:
+// - bool: a boolean value indicating whether the path matches any of the patterns.
+func ExcludeMatched(patterns []string, path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, base); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+// SavePath returns the destination path for file once emailed, mirroring its
+// subdirectory structure under watch relative to the save folder.
+func SavePath(watch, file string) string {
+	rel, err := filepath.Rel(watch, file)
+	if err != nil {
+		rel = filepath.Base(file)
+	}
+	return filepath.Join(watch, "save", rel)
 }
 
 // ExtensionMatched checks if the given extension matches any of the templates.
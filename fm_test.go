@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestExcludeMatched(t *testing.T) {
+	patterns := []string{"*.tmp", filepath.Join("watch", "save")}
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join("watch", "report.tmp"), true},
+		{filepath.Join("watch", "save"), true},
+		{filepath.Join("watch", "save", "sub"), false},
+		{filepath.Join("watch", "report.pdf"), false},
+	}
+	for _, c := range cases {
+		if got := ExcludeMatched(patterns, c.path); got != c.want {
+			t.Errorf("ExcludeMatched(%v, %q) = %v, want %v", patterns, c.path, got, c.want)
+		}
+	}
+}
+
+func TestSavePath(t *testing.T) {
+	watch := filepath.Join("srv", "watch")
+	file := filepath.Join(watch, "incoming", "report.pdf")
+	want := filepath.Join(watch, "save", "incoming", "report.pdf")
+	if got := SavePath(watch, file); got != want {
+		t.Errorf("SavePath(%q, %q) = %q, want %q", watch, file, got, want)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Network filesystem magic numbers as reported by statfs(2), from
+// linux/magic.h/statfs.h. These are the mounts "watch.mode: auto" treats as
+// inotify-unreliable and routes to the polling watcher instead.
+const (
+	nfsSuperMagic  = 0x6969
+	smbSuperMagic  = 0x517b
+	cifsSuperMagic = 0xff534d42
+	smb2SuperMagic = 0xfe534d42
+	ncpSuperMagic  = 0x564c
+	codaSuperMagic = 0x73757245
+)
+
+// isNetworkFilesystem reports whether path sits on an NFS, SMB/CIFS or similar
+// networked mount, where inotify watches can be created successfully but never
+// receive events for files written by other clients.
+func isNetworkFilesystem(path string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return false
+	}
+	switch int64(stat.Type) {
+	case nfsSuperMagic, smbSuperMagic, cifsSuperMagic, smb2SuperMagic, ncpSuperMagic, codaSuperMagic:
+		return true
+	default:
+		return false
+	}
+}
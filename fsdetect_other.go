@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+// isNetworkFilesystem always reports false on platforms other than Linux, where fm
+// has no statfs-based way to tell a network mount from a local one. "watch.mode:
+// auto" still falls back to polling on these platforms if fsnotify.NewWatcher fails.
+func isNetworkFilesystem(path string) bool {
+	return false
+}
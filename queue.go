@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Job is a unit of queued delivery work, persisted as a JSON file under the queue
+// directory so it survives a crash or restart.
+type Job struct {
+	ID          string              `json:"id"`
+	File        string              `json:"file"`
+	Meta        FileMeta            `json:"meta"`
+	Attempts    int                 `json:"attempts"`
+	NextAttempt time.Time           `json:"next_attempt"`
+	LastError   string              `json:"last_error,omitempty"`
+	Status      DeliveryStatus      `json:"status,omitempty"`
+	SplitStatus SplitDeliveryStatus `json:"split_status,omitempty"`
+}
+
+// Queue is a persistent, on-disk send queue: one JSON file per job in dir. It's
+// deliberately just a directory of files rather than BoltDB, so a job can be
+// inspected or hand-edited with nothing but a text editor.
+type Queue struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewQueue opens (creating if necessary) the queue directory at dir.
+func NewQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &Queue{dir: dir}, nil
+}
+
+func (q *Queue) jobPath(id string) string { return filepath.Join(q.dir, id+".json") }
+
+// Enqueue records a new job for file and persists it immediately.
+func (q *Queue) Enqueue(file string, meta FileMeta) (*Job, error) {
+	job := &Job{
+		ID:   fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(file)),
+		File: file,
+		Meta: meta,
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return job, q.save(job)
+}
+
+// Save persists job's current state, e.g. after a failed attempt bumps Attempts.
+func (q *Queue) Save(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.save(job)
+}
+
+func (q *Queue) save(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(q.jobPath(job.ID), data, 0640)
+}
+
+// Remove deletes job's persisted state once it's been delivered or dead-lettered.
+func (q *Queue) Remove(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return os.Remove(q.jobPath(job.ID))
+}
+
+// List returns every pending job, sorted oldest-first by ID.
+func (q *Queue) List() ([]*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(q.dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			continue
+		}
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs, nil
+}
+
+// Has reports whether some job already references file, so the startup scan doesn't
+// requeue a file the crash-recovered queue will already retry.
+func (q *Queue) Has(file string) bool {
+	jobs, err := q.List()
+	if err != nil {
+		return false
+	}
+	for _, job := range jobs {
+		if job.File == file {
+			return true
+		}
+	}
+	return false
+}
+
+// QueueMaxAttempts returns delivery.queue.max_attempts, defaulting to 5.
+func QueueMaxAttempts() int {
+	if n := viper.GetInt("delivery.queue.max_attempts"); n > 0 {
+		return n
+	}
+	return 5
+}
+
+// QueueBackoff computes the retry delay before the given attempt, doubling from
+// delivery.queue.backoff_base up to delivery.queue.backoff_cap, with up to 50%
+// jitter so a batch of failed jobs doesn't all retry in lockstep.
+func QueueBackoff(attempt int) time.Duration {
+	base := viper.GetDuration("delivery.queue.backoff_base")
+	if base <= 0 {
+		base = time.Second
+	}
+	backoffCap := viper.GetDuration("delivery.queue.backoff_cap")
+	if backoffCap <= 0 {
+		backoffCap = 5 * time.Minute
+	}
+
+	delay := base * time.Duration(1<<uint(attempt-1))
+	if delay <= 0 || delay > backoffCap {
+		delay = backoffCap
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// RunQueueWorker drains queue forever, delivering ready jobs and rescheduling or
+// dead-lettering failures, until stop is closed.
+func RunQueueWorker(queue *Queue, deliverers []namedDeliverer, watch string, stop <-chan struct{}) {
+	interval := viper.GetDuration("delivery.queue.poll_interval")
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			drainQueue(queue, deliverers, watch)
+		}
+	}
+}
+
+func drainQueue(queue *Queue, deliverers []namedDeliverer, watch string) {
+	jobs, err := queue.List()
+	if err != nil {
+		log.Println("queue error:", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if time.Now().Before(job.NextAttempt) {
+			continue
+		}
+		if _, err := os.Stat(job.File); err != nil {
+			log.Println("Queue: dropping job for missing file", job.File)
+			queue.Remove(job)
+			continue
+		}
+
+		var derr error
+		if split, _ := NeedsSplit(job.File); split {
+			if job.SplitStatus == nil {
+				job.SplitStatus = SplitDeliveryStatus{}
+			}
+			derr = DeliverSplit(context.Background(), deliverers, job.File, job.Meta, job.SplitStatus)
+		} else {
+			if job.Status == nil {
+				job.Status = DeliveryStatus{}
+			}
+			derr = Deliver(context.Background(), deliverers, job.File, job.Meta, job.Status)
+		}
+
+		if derr == nil {
+			dest := SavePath(watch, job.File)
+			if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+				derr = fmt.Errorf("create save dir for %s: %w", job.Meta.Base, err)
+			} else if err := os.Rename(job.File, dest); err != nil {
+				derr = fmt.Errorf("move %s to save: %w", job.Meta.Base, err)
+			} else {
+				queue.Remove(job)
+				log.Println("File:", job.Meta.Base, "has been sent to addressees")
+				continue
+			}
+			// Delivery itself succeeded (job.Status/SplitStatus now mark every backend
+			// done), so a retry here only re-attempts the move, not the send: Deliver
+			// and DeliverSplit skip any backend already marked delivered in status.
+		}
+
+		job.Attempts++
+		job.LastError = derr.Error()
+		if job.Attempts >= QueueMaxAttempts() {
+			deadLetter(queue, job, watch)
+			continue
+		}
+		job.NextAttempt = time.Now().Add(QueueBackoff(job.Attempts))
+		queue.Save(job)
+		log.Println("Queue: retrying", job.Meta.Base, "attempt", job.Attempts, "after error:", derr)
+	}
+}
+
+// deadLetter moves a job's file to delivery.queue.dead_letter_dir once it's exhausted
+// its retries, and drops the job.
+func deadLetter(queue *Queue, job *Job, watch string) {
+	dir := viper.GetString("delivery.queue.dead_letter_dir")
+	if dir == "" {
+		dir = filepath.Join(watch, "dead-letter")
+	}
+	os.MkdirAll(dir, 0750)
+	if err := os.Rename(job.File, filepath.Join(dir, job.Meta.Base)); err != nil {
+		log.Println("Queue: dead-letter move failed:", err)
+	}
+	queue.Remove(job)
+	log.Println("File:", job.Meta.Base, "moved to dead-letter after", job.Attempts, "attempts, last error:", job.LastError)
+}
+
+// ScanWatchFolder walks watch for files matching filetypes that aren't already
+// queued, and enqueues them. Combined with the queue's own crash recovery, this
+// covers files that arrived (or whose Create event was missed) while fm was down.
+func ScanWatchFolder(watch string, filetypes, partials, excludes []string, queue *Queue) {
+	filepath.Walk(watch, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != watch && ExcludeMatched(excludes, path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ExcludeMatched(excludes, path) || IsPartialFile(partials, path) {
+			return nil
+		}
+		if !ExtensionMatched(filetypes, filepath.Ext(path)) {
+			return nil
+		}
+		if queue.Has(path) {
+			return nil
+		}
+		if _, err := queue.Enqueue(path, NewFileMeta(path)); err != nil {
+			log.Println("Queue: enqueue on startup scan failed:", err)
+		}
+		return nil
+	})
+}
+
+// ServeMetrics starts an HTTP server on addr exposing queue depth and the last
+// delivery error in Prometheus text format at /metrics. It's a no-op if addr is empty.
+func ServeMetrics(addr string, queue *Queue) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := queue.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lastError := ""
+		for _, job := range jobs {
+			if job.LastError != "" {
+				lastError = job.LastError
+			}
+		}
+
+		fmt.Fprintln(w, "# HELP fm_queue_depth Number of files waiting in the send queue.")
+		fmt.Fprintln(w, "# TYPE fm_queue_depth gauge")
+		fmt.Fprintf(w, "fm_queue_depth %d\n", len(jobs))
+		fmt.Fprintln(w, "# HELP fm_queue_last_error_info Last delivery error seen by the queue worker.")
+		fmt.Fprintln(w, "# TYPE fm_queue_last_error_info gauge")
+		fmt.Fprintf(w, "fm_queue_last_error_info{error=%q} 1\n", lastError)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("Metrics server error:", err)
+		}
+	}()
+}
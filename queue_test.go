@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestQueueBackoff(t *testing.T) {
+	viper.Set("delivery.queue.backoff_base", time.Second)
+	viper.Set("delivery.queue.backoff_cap", 10*time.Second)
+	defer viper.Set("delivery.queue.backoff_base", nil)
+	defer viper.Set("delivery.queue.backoff_cap", nil)
+
+	for attempt := 1; attempt <= 6; attempt++ {
+		delay := QueueBackoff(attempt)
+		if delay <= 0 {
+			t.Errorf("attempt %d: delay = %v, want > 0", attempt, delay)
+		}
+		if delay > 10*time.Second {
+			t.Errorf("attempt %d: delay = %v, want <= backoff_cap 10s", attempt, delay)
+		}
+	}
+}
+
+func TestQueueBackoffGrowsWithAttempts(t *testing.T) {
+	viper.Set("delivery.queue.backoff_base", time.Second)
+	viper.Set("delivery.queue.backoff_cap", time.Hour)
+	defer viper.Set("delivery.queue.backoff_base", nil)
+	defer viper.Set("delivery.queue.backoff_cap", nil)
+
+	// With jitter up to 50%, attempt 5's minimum possible delay (base*2^4 / 2) should
+	// still exceed attempt 1's maximum possible delay (base*2^0).
+	minAttempt5 := 16 * time.Second / 2
+	maxAttempt1 := time.Second
+
+	for i := 0; i < 20; i++ {
+		if delay := QueueBackoff(1); delay > maxAttempt1 {
+			t.Errorf("QueueBackoff(1) = %v, want <= %v", delay, maxAttempt1)
+		}
+		if delay := QueueBackoff(5); delay < minAttempt5 {
+			t.Errorf("QueueBackoff(5) = %v, want >= %v", delay, minAttempt5)
+		}
+	}
+}
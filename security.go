@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/mastahyeti/go-smime"
+	"github.com/spf13/viper"
+)
+
+// defaultKeyserver is queried over HKPS when a configured recipient key can't be
+// found in the local security.keyring.
+const defaultKeyserver = "https://keys.openpgp.org"
+
+// SecurityMode returns the configured security.mode, defaulting to "none".
+func SecurityMode() string {
+	if mode := viper.GetString("security.mode"); mode != "" {
+		return mode
+	}
+	return "none"
+}
+
+// ProtectFile runs file through the configured security.mode, returning the path to
+// attach in its place (the original file for "none" and sign-only modes, an encrypted
+// copy otherwise), an optional detached signature path to attach alongside it, and a
+// cleanup func to remove any files ProtectFile created. It's applied once per
+// attachment, so a multi-volume series gets one signature/ciphertext per volume
+// rather than one for the whole series.
+func ProtectFile(file string, meta FileMeta) (attachPath, sigPath string, cleanup func(), err error) {
+	noop := func() {}
+	switch SecurityMode() {
+	case "", "none":
+		return file, "", noop, nil
+	case "pgp-sign":
+		sigPath, err = pgpDetachSign(file)
+		if err != nil {
+			return "", "", noop, err
+		}
+		return file, sigPath, func() { os.Remove(sigPath) }, nil
+	case "pgp-encrypt":
+		attachPath, err = pgpEncrypt(file, meta.Addressees, false)
+		if err != nil {
+			return "", "", noop, err
+		}
+		return attachPath, "", func() { os.Remove(attachPath) }, nil
+	case "pgp-sign-encrypt":
+		attachPath, err = pgpEncrypt(file, meta.Addressees, true)
+		if err != nil {
+			return "", "", noop, err
+		}
+		return attachPath, "", func() { os.Remove(attachPath) }, nil
+	case "smime-sign":
+		sigPath, err = smimeDetachSign(file)
+		if err != nil {
+			return "", "", noop, err
+		}
+		return file, sigPath, func() { os.Remove(sigPath) }, nil
+	case "smime-encrypt":
+		attachPath, err = smimeEncrypt(file, meta.Addressees)
+		if err != nil {
+			return "", "", noop, err
+		}
+		return attachPath, "", func() { os.Remove(attachPath) }, nil
+	default:
+		return "", "", noop, fmt.Errorf("unknown security.mode %q", SecurityMode())
+	}
+}
+
+// pgpSigner loads and unlocks the signing identity from security.keyring using
+// security.passphrase_file.
+func pgpSigner() (*openpgp.Entity, error) {
+	ring, err := loadPGPKeyRing(viper.GetString("security.keyring"))
+	if err != nil {
+		return nil, err
+	}
+	if len(ring) == 0 {
+		return nil, fmt.Errorf("security.keyring %s has no keys", viper.GetString("security.keyring"))
+	}
+	signer := ring[0]
+
+	if passphraseFile := viper.GetString("security.passphrase_file"); passphraseFile != "" {
+		passphrase, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase file: %w", err)
+		}
+		passphrase = bytes.TrimSpace(passphrase)
+		if signer.PrivateKey != nil && signer.PrivateKey.Encrypted {
+			if err := signer.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("unlock signing key: %w", err)
+			}
+		}
+		// A keyring that signs with a dedicated signing subkey (primary key kept
+		// offline) still has that subkey's private key encrypted at this point;
+		// openpgp.ArmoredDetachSign/Encrypt pick whichever signing-capable key they
+		// find, so every one of them needs unlocking, not just the primary.
+		for _, subkey := range signer.Subkeys {
+			if subkey.PrivateKey == nil || !subkey.PrivateKey.Encrypted {
+				continue
+			}
+			if subkey.Sig == nil || !subkey.Sig.FlagSign {
+				continue
+			}
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("unlock signing subkey: %w", err)
+			}
+		}
+	}
+	return signer, nil
+}
+
+func loadPGPKeyRing(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open keyring %s: %w", path, err)
+	}
+	defer f.Close()
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+func pgpDetachSign(file string) (string, error) {
+	signer, err := pgpSigner()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer plaintext.Close()
+
+	sigPath := file + ".asc"
+	sig, err := os.Create(sigPath)
+	if err != nil {
+		return "", err
+	}
+	defer sig.Close()
+
+	if err := openpgp.ArmoredDetachSign(sig, signer, plaintext, nil); err != nil {
+		return "", fmt.Errorf("pgp sign %s: %w", filepath.Base(file), err)
+	}
+	return sigPath, nil
+}
+
+func pgpEncrypt(file string, addressees []string, sign bool) (string, error) {
+	ring, err := loadPGPKeyRing(viper.GetString("security.keyring"))
+	if err != nil {
+		return "", err
+	}
+	recipients, err := resolvePGPRecipients(ring, addressees)
+	if err != nil {
+		return "", err
+	}
+
+	var signer *openpgp.Entity
+	if sign {
+		signer, err = pgpSigner()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	plaintext, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer plaintext.Close()
+
+	outPath := file + ".pgp"
+	out, err := os.Create(outPath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	w, err := openpgp.Encrypt(out, recipients, signer, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("pgp encrypt %s: %w", filepath.Base(file), err)
+	}
+	if _, err := io.Copy(w, plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return outPath, nil
+}
+
+// resolvePGPRecipients looks each addressee up in security.recipient_keys (a map of
+// email to key ID or identity name), first against the local keyring and, failing
+// that, against the configured HKPS keyserver. A file path as the value is not read.
+func resolvePGPRecipients(ring openpgp.EntityList, addressees []string) ([]*openpgp.Entity, error) {
+	keyRefs := viper.GetStringMapString("security.recipient_keys")
+	recipients := make([]*openpgp.Entity, 0, len(addressees))
+	for _, addressee := range addressees {
+		keyID, ok := keyRefs[addressee]
+		if !ok {
+			return nil, fmt.Errorf("no security.recipient_keys entry for %s", addressee)
+		}
+
+		if entity := findPGPEntity(ring, keyID); entity != nil {
+			recipients = append(recipients, entity)
+			continue
+		}
+		entity, err := fetchPGPKeyFromKeyserver(keyID)
+		if err != nil {
+			return nil, fmt.Errorf("resolve pgp key for %s: %w", addressee, err)
+		}
+		recipients = append(recipients, entity)
+	}
+	return recipients, nil
+}
+
+func findPGPEntity(ring openpgp.EntityList, keyID string) *openpgp.Entity {
+	for _, entity := range ring {
+		for id := range entity.Identities {
+			if id == keyID {
+				return entity
+			}
+		}
+		if entity.PrimaryKey != nil && fmt.Sprintf("%X", entity.PrimaryKey.KeyId) == strings.ToUpper(keyID) {
+			return entity
+		}
+	}
+	return nil
+}
+
+// fetchPGPKeyFromKeyserver fetches keyID from security.keyserver (or
+// defaultKeyserver) over HKPS.
+func fetchPGPKeyFromKeyserver(keyID string) (*openpgp.Entity, error) {
+	keyserver := viper.GetString("security.keyserver")
+	if keyserver == "" {
+		keyserver = defaultKeyserver
+	}
+	url := fmt.Sprintf("%s/pks/lookup?op=get&options=mr&search=0x%s", keyserver, keyID)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keyserver lookup for %s: unexpected status %s", keyID, resp.Status)
+	}
+
+	ring, err := openpgp.ReadArmoredKeyRing(resp.Body)
+	if err != nil || len(ring) == 0 {
+		return nil, fmt.Errorf("no key returned for %s", keyID)
+	}
+	return ring[0], nil
+}
+
+// smimeIdentity loads the local signing/encryption cert and key from
+// security.keyring (a PEM bundle containing both).
+func smimeIdentity() (*x509.Certificate, any, error) {
+	pemBytes, err := os.ReadFile(viper.GetString("security.keyring"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read smime identity %s: %w", viper.GetString("security.keyring"), err)
+	}
+
+	var cert *x509.Certificate
+	var key any
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err = x509.ParseCertificate(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("%s must contain both a CERTIFICATE and a PRIVATE KEY block", viper.GetString("security.keyring"))
+	}
+	return cert, key, nil
+}
+
+func smimeDetachSign(file string) (string, error) {
+	cert, key, err := smimeIdentity()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	signed, err := smime.Sign(data, cert, key, smime.DetachedSignature)
+	if err != nil {
+		return "", fmt.Errorf("smime sign %s: %w", filepath.Base(file), err)
+	}
+
+	sigPath := file + ".p7s"
+	if err := os.WriteFile(sigPath, signed, 0640); err != nil {
+		return "", err
+	}
+	return sigPath, nil
+}
+
+func smimeEncrypt(file string, addressees []string) (string, error) {
+	certs, err := resolveSMIMERecipients(addressees)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := smime.Encrypt(data, certs)
+	if err != nil {
+		return "", fmt.Errorf("smime encrypt %s: %w", filepath.Base(file), err)
+	}
+
+	outPath := file + ".p7m"
+	if err := os.WriteFile(outPath, encrypted, 0640); err != nil {
+		return "", err
+	}
+	return outPath, nil
+}
+
+// resolveSMIMERecipients reads each addressee's certificate path from
+// security.recipient_keys.
+func resolveSMIMERecipients(addressees []string) ([]*x509.Certificate, error) {
+	certPaths := viper.GetStringMapString("security.recipient_keys")
+	certs := make([]*x509.Certificate, 0, len(addressees))
+	for _, addressee := range addressees {
+		path, ok := certPaths[addressee]
+		if !ok {
+			return nil, fmt.Errorf("no security.recipient_keys entry for %s", addressee)
+		}
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read cert for %s: %w", addressee, err)
+		}
+		block, _ := pem.Decode(pemBytes)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block in cert for %s", addressee)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse cert for %s: %w", addressee, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
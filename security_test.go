@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSecurityModeDefaultsToNone(t *testing.T) {
+	defer viper.Set("security.mode", nil)
+
+	if got := SecurityMode(); got != "none" {
+		t.Errorf("SecurityMode() with nothing configured = %q, want %q", got, "none")
+	}
+
+	viper.Set("security.mode", "pgp-encrypt")
+	if got := SecurityMode(); got != "pgp-encrypt" {
+		t.Errorf("SecurityMode() = %q, want %q", got, "pgp-encrypt")
+	}
+}
+
+func TestProtectFileNoneModePassesFileThrough(t *testing.T) {
+	defer viper.Set("security.mode", nil)
+	viper.Set("security.mode", "none")
+
+	attachPath, sigPath, cleanup, err := ProtectFile("report.pdf", FileMeta{Base: "report.pdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if attachPath != "report.pdf" {
+		t.Errorf("attachPath = %q, want the original file unchanged", attachPath)
+	}
+	if sigPath != "" {
+		t.Errorf("sigPath = %q, want empty for security.mode none", sigPath)
+	}
+}
+
+func TestProtectFileUnknownModeErrors(t *testing.T) {
+	defer viper.Set("security.mode", nil)
+	viper.Set("security.mode", "rot13")
+
+	if _, _, _, err := ProtectFile("report.pdf", FileMeta{Base: "report.pdf"}); err == nil {
+		t.Error("ProtectFile with an unknown security.mode returned no error")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// defaultMaxAttachmentBytes is the default per-part limit, counted in bytes of the
+// original file. Base64 encoding grows each part by roughly 4/3, so an encoded part
+// of this size is about 26.7 MiB.
+const defaultMaxAttachmentBytes = 20 * 1024 * 1024
+
+// SplitPart describes one chunk of a file split by SplitFile.
+type SplitPart struct {
+	Path   string // path to the base64-encoded chunk on disk
+	Index  int    // 1-based
+	Total  int
+	Size   int64  // size of the decoded chunk, in bytes
+	SHA256 string // sha256 of the decoded chunk
+}
+
+// MaxAttachmentBytes returns the configured email.max_attachment_bytes, defaulting to
+// defaultMaxAttachmentBytes.
+func MaxAttachmentBytes() int64 {
+	if n := viper.GetInt64("email.max_attachment_bytes"); n > 0 {
+		return n
+	}
+	return defaultMaxAttachmentBytes
+}
+
+// NeedsSplit reports whether file is too big to deliver as a single attachment.
+func NeedsSplit(file string) (bool, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	return info.Size() > MaxAttachmentBytes(), nil
+}
+
+// SplitFile splits file into chunks of at most MaxAttachmentBytes, base64-encodes
+// each into its own temp file, and returns them alongside the SHA-256 of the whole,
+// unsplit file. Callers are responsible for removing filepath.Dir of the first part
+// once delivery is done.
+func SplitFile(file string) (parts []SplitPart, wholeSHA256 string, err error) {
+	maxBytes := MaxAttachmentBytes()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	total := int((info.Size() + maxBytes - 1) / maxBytes)
+
+	tmpDir, err := os.MkdirTemp("", "fm-split-")
+	if err != nil {
+		return nil, "", err
+	}
+
+	whole := sha256.New()
+	buf := make([]byte, maxBytes)
+	for index := 1; ; index++ {
+		n, rerr := io.ReadFull(f, buf)
+		if n > 0 {
+			chunk := buf[:n]
+			whole.Write(chunk)
+
+			sum := sha256.Sum256(chunk)
+			encoded := make([]byte, base64.StdEncoding.EncodedLen(len(chunk)))
+			base64.StdEncoding.Encode(encoded, chunk)
+
+			partPath := filepath.Join(tmpDir, fmt.Sprintf("%s.part%03d.b64", filepath.Base(file), index))
+			if err := os.WriteFile(partPath, encoded, 0640); err != nil {
+				os.RemoveAll(tmpDir)
+				return nil, "", err
+			}
+			parts = append(parts, SplitPart{
+				Path:   partPath,
+				Index:  index,
+				Total:  total,
+				Size:   int64(len(chunk)),
+				SHA256: hex.EncodeToString(sum[:]),
+			})
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			os.RemoveAll(tmpDir)
+			return nil, "", rerr
+		}
+	}
+	return parts, hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+// Manifest renders the body of the manifest email: the whole file's SHA-256 plus the
+// size and SHA-256 of every part, so the recipient can verify reassembly.
+func Manifest(base, wholeSHA256 string, parts []SplitPart) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s was too large to send as a single attachment and was split into %d parts.\n\n", base, len(parts))
+	fmt.Fprintf(&b, "Whole file SHA-256: %s\n\n", wholeSHA256)
+	for _, part := range parts {
+		fmt.Fprintf(&b, "part %d/%d: %s  %d bytes  sha256:%s\n",
+			part.Index, part.Total, filepath.Base(part.Path), part.Size, part.SHA256)
+	}
+	b.WriteString("\nBase64-decode each part and concatenate them in order to reassemble, " +
+		"or run the attached reassemble.sh next to all parts.\n")
+	return b.String()
+}
+
+// WriteReassemblyScript writes a small shell script, next to the split parts, that
+// base64-decodes each part in order and concatenates them back into name.
+func WriteReassemblyScript(dir, name string, parts []SplitPart) (string, error) {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Reassembles %s from its base64-encoded parts.\n", name)
+	fmt.Fprintf(&b, "set -e\n")
+	fmt.Fprintf(&b, "rm -f %q\n", name)
+	for _, part := range parts {
+		fmt.Fprintf(&b, "base64 -d %q >> %q\n", filepath.Base(part.Path), name)
+	}
+	b.WriteString("echo reassembled " + name + "\n")
+
+	scriptPath := filepath.Join(dir, "reassemble.sh")
+	if err := os.WriteFile(scriptPath, []byte(b.String()), 0750); err != nil {
+		return "", err
+	}
+	return scriptPath, nil
+}
+
+// partKey identifies a split part within a SplitDeliveryStatus.
+func partKey(index int) string {
+	return fmt.Sprintf("part-%d", index)
+}
+
+// manifestKey identifies the manifest/reassembly-script message within a
+// SplitDeliveryStatus.
+const manifestKey = "manifest"
+
+// DeliverSplit splits file, delivers each part as a numbered series, and finishes
+// with a manifest message containing the whole file's SHA-256 and a reassembly
+// script attachment. status tracks per-part, per-backend delivery so a retry after a
+// partial failure only resumes the parts (and backends within a part) that haven't
+// been delivered yet, rather than resending the whole series.
+func DeliverSplit(ctx context.Context, deliverers []namedDeliverer, file string, meta FileMeta, status SplitDeliveryStatus) error {
+	parts, wholeSHA256, err := SplitFile(file)
+	if err != nil {
+		return fmt.Errorf("split file %s\n error: %s", meta.Base, err.Error())
+	}
+	tmpDir := filepath.Dir(parts[0].Path)
+	defer os.RemoveAll(tmpDir)
+
+	for _, part := range parts {
+		key := partKey(part.Index)
+		partStatus := status.forKey(key)
+		if partStatus.delivered(deliverers) {
+			continue
+		}
+		partMeta := meta
+		partMeta.Base = filepath.Base(part.Path)
+		partMeta.Subject = fmt.Sprintf("%s (part %d/%d)", meta.Base, part.Index, part.Total)
+		if err := Deliver(ctx, deliverers, part.Path, partMeta, partStatus); err != nil {
+			return err
+		}
+	}
+
+	scriptPath, err := WriteReassemblyScript(tmpDir, meta.Base, parts)
+	if err != nil {
+		return fmt.Errorf("write reassembly script for %s\n error: %s", meta.Base, err.Error())
+	}
+
+	manifestStatus := status.forKey(manifestKey)
+	if manifestStatus.delivered(deliverers) {
+		return nil
+	}
+	manifestMeta := meta
+	manifestMeta.Base = "reassemble.sh"
+	manifestMeta.Subject = fmt.Sprintf("%s (manifest)", meta.Base)
+	manifestMeta.Body = Manifest(meta.Base, wholeSHA256, parts)
+	return Deliver(ctx, deliverers, scriptPath, manifestMeta, manifestStatus)
+}
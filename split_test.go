@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSplitFileReassembles(t *testing.T) {
+	viper.Set("email.max_attachment_bytes", 10)
+	defer viper.Set("email.max_attachment_bytes", nil)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "archive.tar.gz")
+	content := []byte("0123456789abcdefghij") // 20 bytes -> 2 parts of 10
+	if err := os.WriteFile(file, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	parts, wholeSHA256, err := SplitFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(parts[0].Path))
+
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+
+	var reassembled bytes.Buffer
+	for i, part := range parts {
+		if part.Index != i+1 || part.Total != 2 {
+			t.Errorf("part %d: Index=%d Total=%d", i, part.Index, part.Total)
+		}
+		encoded, err := os.ReadFile(part.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reassembled.Write(decoded)
+	}
+	if reassembled.String() != string(content) {
+		t.Errorf("reassembled content = %q, want %q", reassembled.String(), content)
+	}
+
+	manifest := Manifest("archive.tar.gz", wholeSHA256, parts)
+	if !strings.Contains(manifest, wholeSHA256) {
+		t.Errorf("manifest missing whole-file sha256 %s:\n%s", wholeSHA256, manifest)
+	}
+	for _, part := range parts {
+		if !strings.Contains(manifest, part.SHA256) {
+			t.Errorf("manifest missing part sha256 %s:\n%s", part.SHA256, manifest)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StabilityTracker watches newly created files until their size and modification time
+// stop changing across N consecutive polls, then reports them as stable via onStable.
+// This replaces a fixed post-Create sleep, which races when large multi-volume archive
+// writers (7z, rar, zip) trickle data over many seconds: polling coalesces the many
+// fsnotify.Write events such a writer produces into a single stability decision.
+type StabilityTracker struct {
+	mu       sync.Mutex
+	pending  map[string]struct{}
+	interval time.Duration
+	checks   int
+	onStable func(path string)
+}
+
+// NewStabilityTracker creates a tracker that polls every interval and requires checks
+// consecutive unchanged observations before calling onStable for a tracked file.
+func NewStabilityTracker(interval time.Duration, checks int, onStable func(path string)) *StabilityTracker {
+	return &StabilityTracker{
+		pending:  make(map[string]struct{}),
+		interval: interval,
+		checks:   checks,
+		onStable: onStable,
+	}
+}
+
+// Track begins watching path for stability, unless it's already being tracked. Errors
+// reading the file (e.g. it was removed before settling) simply stop the tracking.
+func (t *StabilityTracker) Track(path string) {
+	t.mu.Lock()
+	if _, tracked := t.pending[path]; tracked {
+		t.mu.Unlock()
+		return
+	}
+	t.pending[path] = struct{}{}
+	t.mu.Unlock()
+
+	go t.watch(path)
+}
+
+func (t *StabilityTracker) watch(path string) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, path)
+		t.mu.Unlock()
+	}()
+
+	var lastSize int64
+	var lastMod time.Time
+	stable := 0
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if info.Size() == lastSize && info.ModTime().Equal(lastMod) {
+			stable++
+		} else {
+			stable = 0
+			lastSize = info.Size()
+			lastMod = info.ModTime()
+		}
+		if stable >= t.checks {
+			t.onStable(path)
+			return
+		}
+	}
+}
+
+// IsPartialFile reports whether path carries one of the configured temp/partial
+// suffixes (e.g. ".part", ".tmp", ".crdownload") and should be left alone until the
+// writer renames it away.
+func IsPartialFile(suffixes []string, path string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
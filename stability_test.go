@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStabilityTrackerReportsOnceSizeStopsChanging(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "archive.7z.001")
+	if err := os.WriteFile(file, []byte("a"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	stableCh := make(chan string, 1)
+	tracker := NewStabilityTracker(20*time.Millisecond, 2, func(path string) {
+		stableCh <- path
+	})
+	tracker.Track(file)
+
+	// Simulate a writer still trickling data in: as long as the file keeps growing,
+	// onStable must not fire.
+	time.Sleep(30 * time.Millisecond)
+	if err := os.WriteFile(file, []byte("ab"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case path := <-stableCh:
+		t.Fatalf("onStable fired early for %s while the file was still growing", path)
+	case <-time.After(40 * time.Millisecond):
+	}
+
+	select {
+	case path := <-stableCh:
+		if path != file {
+			t.Errorf("onStable called with %q, want %q", path, file)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("onStable was never called once the file stopped changing")
+	}
+}
+
+func TestIsPartialFile(t *testing.T) {
+	suffixes := []string{".part", ".tmp", ".crdownload"}
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"archive.zip.part", true},
+		{"download.crdownload", true},
+		{"archive.zip", false},
+	}
+	for _, c := range cases {
+		if got := IsPartialFile(suffixes, c.path); got != c.want {
+			t.Errorf("IsPartialFile(%v, %q) = %v, want %v", suffixes, c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// FileWatcher abstracts the directory-watching backend used by main, so that an
+// inotify-based watcher and a polling fallback can be swapped via the "watch.mode"
+// config key without touching the event loop.
+type FileWatcher interface {
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Add(path string) error
+	Remove(path string) error
+	Close() error
+}
+
+// NewFileWatcher builds the FileWatcher selected by mode ("auto", "fsnotify" or
+// "poll") for the given watch folder.
+//
+// "fsnotify" always uses fsnotify.NewWatcher. "poll" always uses the polling fallback.
+// "auto" (and any other value) uses the polling fallback when watch sits on a
+// filesystem such as NFS or SMB, where creating an inotify watch succeeds but events
+// from other clients' writes never arrive, and otherwise prefers fsnotify, falling
+// back to polling if fsnotify.NewWatcher itself fails (e.g. inotify instance limits).
+func NewFileWatcher(mode string, watch string) (FileWatcher, error) {
+	switch mode {
+	case "poll":
+		return NewPollWatcher(pollInterval()), nil
+	case "fsnotify":
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		return &fsnotifyWatcher{w}, nil
+	default:
+		if isNetworkFilesystem(watch) {
+			log.Println("watch folder is on a network filesystem, using polling watcher:", watch)
+			return NewPollWatcher(pollInterval()), nil
+		}
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Println("fsnotify unavailable, falling back to polling watcher:", err)
+			return NewPollWatcher(pollInterval()), nil
+		}
+		return &fsnotifyWatcher{w}, nil
+	}
+}
+
+// pollInterval returns the configured watch.poll_interval, defaulting to 2 seconds.
+func pollInterval() time.Duration {
+	if d := viper.GetDuration("watch.poll_interval"); d > 0 {
+		return d
+	}
+	return 2 * time.Second
+}
+
+// fsnotifyWatcher adapts *fsnotify.Watcher to the FileWatcher interface.
+type fsnotifyWatcher struct {
+	w *fsnotify.Watcher
+}
+
+func (f *fsnotifyWatcher) Events() <-chan fsnotify.Event { return f.w.Events }
+func (f *fsnotifyWatcher) Errors() <-chan error          { return f.w.Errors }
+func (f *fsnotifyWatcher) Add(path string) error         { return f.w.Add(path) }
+func (f *fsnotifyWatcher) Remove(path string) error      { return f.w.Remove(path) }
+func (f *fsnotifyWatcher) Close() error                  { return f.w.Close() }
+
+// pollWatcher is a FileWatcher that periodically os.ReadDirs its watched folders and
+// diffs the result against a cached map of entry mtimes, emitting a synthetic
+// fsnotify.Create event for every name it hasn't seen before. It's the fallback for
+// filesystems where inotify is unreliable, such as networked mail-drop directories.
+type pollWatcher struct {
+	mu       sync.Mutex
+	folders  map[string]map[string]time.Time
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	closed   chan struct{}
+}
+
+// NewPollWatcher creates a pollWatcher that scans its watched folders every interval.
+func NewPollWatcher(interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		folders:  make(map[string]map[string]time.Time),
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.closed:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+func (w *pollWatcher) poll() {
+	w.mu.Lock()
+	folders := make([]string, 0, len(w.folders))
+	for folder := range w.folders {
+		folders = append(folders, folder)
+	}
+	w.mu.Unlock()
+
+	for _, folder := range folders {
+		entries, err := os.ReadDir(folder)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The folder itself is gone, not just unreadable: evict it so it isn't
+				// polled (and erroring) forever, and tell the main loop the same way
+				// fsnotify would, so both backends drop the watch the same way.
+				w.mu.Lock()
+				delete(w.folders, folder)
+				w.mu.Unlock()
+				select {
+				case w.events <- fsnotify.Event{Name: folder, Op: fsnotify.Remove}:
+				case <-w.closed:
+					return
+				}
+				continue
+			}
+			select {
+			case w.errors <- err:
+			case <-w.closed:
+				return
+			}
+			continue
+		}
+
+		w.mu.Lock()
+		previous := w.folders[folder]
+		w.mu.Unlock()
+
+		// seen is rebuilt from scratch every pass, rather than mutated in place, so a
+		// name that has disappeared (e.g. moved out to save/) is dropped instead of
+		// lingering forever; if it's recreated later, it's absent from seen and fires
+		// a Create event again instead of being silently swallowed as "already known".
+		seen := make(map[string]time.Time, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			name := entry.Name()
+			if _, known := previous[name]; !known {
+				path := filepath.Join(folder, name)
+				select {
+				case w.events <- fsnotify.Event{Name: path, Op: fsnotify.Create}:
+				case <-w.closed:
+					return
+				}
+			}
+			seen[name] = info.ModTime()
+		}
+
+		w.mu.Lock()
+		w.folders[folder] = seen
+		w.mu.Unlock()
+	}
+}
+
+func (w *pollWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *pollWatcher) Errors() <-chan error          { return w.errors }
+
+// Add registers folder for polling. Its current contents are recorded as a baseline
+// and will not themselves be reported as Create events.
+func (w *pollWatcher) Add(folder string) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			seen[entry.Name()] = info.ModTime()
+		}
+	}
+	w.mu.Lock()
+	w.folders[folder] = seen
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *pollWatcher) Remove(folder string) error {
+	w.mu.Lock()
+	delete(w.folders, folder)
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.closed)
+	return nil
+}
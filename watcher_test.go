@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPollWatcherDetectsRecreatedName(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "daily.tar.gz")
+	if err := os.WriteFile(file, []byte("first"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewPollWatcher(time.Hour) // poll() is called directly below, not on a ticker
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	w.poll()
+
+	if err := os.WriteFile(file, []byte("second"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() { w.poll(); close(done) }()
+
+	select {
+	case event := <-w.Events():
+		if event.Name != file || !event.Has(fsnotify.Create) {
+			t.Errorf("got event %+v, want a Create event for %s", event, file)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recreated file was not reported as a new Create event")
+	}
+	<-done
+}